@@ -0,0 +1,41 @@
+package promscrape
+
+import (
+	"fmt"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/promscrape/discovery/consul"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/promscrape/discovery/consulkv"
+)
+
+// ScrapeConfig is a single entry of the top-level `scrape_configs` list.
+//
+// This tree only carries the Consul-backed service discovery providers; upstream's
+// scrape_configs union also has kubernetes_sd_configs, dns_sd_configs, ec2_sd_configs and several
+// others that aren't part of this package tree.
+type ScrapeConfig struct {
+	JobName string `yaml:"job_name"`
+
+	ConsulSDConfigs   []consul.SDConfig   `yaml:"consul_sd_configs,omitempty"`
+	ConsulKVSDConfigs []consulkv.SDConfig `yaml:"consul_kv_sd_configs,omitempty"`
+}
+
+// GetLabels returns the target labels discovered by every service discovery provider configured
+// for sc, merging the results from each configured SD type.
+func (sc *ScrapeConfig) GetLabels(baseDir string) ([]map[string]string, error) {
+	var ms []map[string]string
+	for i := range sc.ConsulSDConfigs {
+		labels, err := consul.GetLabels(&sc.ConsulSDConfigs[i], baseDir)
+		if err != nil {
+			return nil, fmt.Errorf("error when discovering consul targets for job_name=%q: %w", sc.JobName, err)
+		}
+		ms = append(ms, labels...)
+	}
+	for i := range sc.ConsulKVSDConfigs {
+		labels, err := consulkv.GetLabels(&sc.ConsulKVSDConfigs[i], baseDir)
+		if err != nil {
+			return nil, fmt.Errorf("error when discovering consul_kv targets for job_name=%q: %w", sc.JobName, err)
+		}
+		ms = append(ms, labels...)
+	}
+	return ms, nil
+}
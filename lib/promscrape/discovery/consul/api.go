@@ -1,6 +1,7 @@
 package consul
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -17,14 +18,25 @@ import (
 
 var waitTime = flag.Duration("promscrape.consul.waitTime", 0, "Wait time used by Consul service discovery. Default value is used if not set")
 
+// staleRetryDelay is how long GetBlockingAPIResponse waits before retrying after discarding a
+// stale response, so a partitioned or persistently-lagging Consul cluster is polled instead of
+// hammered in a tight loop.
+const staleRetryDelay = time.Second
+
 // apiConfig contains config for API server.
 type apiConfig struct {
-	tagSeparator  string
-	consulWatcher *consulWatcher
+	tagSeparator string
+	// consulWatchers holds one watcher per watched namespace.
+	// It contains a single entry unless Namespace="*" fans out across all Consul Enterprise namespaces.
+	consulWatchers []*consulWatcher
+	tokenRenewer   *tokenRenewer
 }
 
 func (ac *apiConfig) mustStop() {
-	ac.consulWatcher.mustStop()
+	for _, cw := range ac.consulWatchers {
+		cw.mustStop()
+	}
+	ac.tokenRenewer.mustStop()
 }
 
 var configMap = discoveryutils.NewConfigMap()
@@ -38,7 +50,7 @@ func getAPIConfig(sdc *SDConfig, baseDir string) (*apiConfig, error) {
 }
 
 func newAPIConfig(sdc *SDConfig, baseDir string) (*apiConfig, error) {
-	token, err := getToken(sdc.Token)
+	token, err := getToken(sdc)
 	if err != nil {
 		return nil, err
 	}
@@ -73,6 +85,16 @@ func newAPIConfig(sdc *SDConfig, baseDir string) (*apiConfig, error) {
 	if err != nil {
 		return nil, fmt.Errorf("cannot create HTTP client for %q: %w", apiServer, err)
 	}
+	// Only preflight a token sourced from TokenFile: that's the only case where a token can be
+	// freshly-issued and not yet replicated to the local agent. A static `token:`/env-var token has
+	// presumably been in use already, and preflighting it here would turn an agent that can't serve
+	// /v1/acl/token/self (older Consul, a restrictive ACL policy, etc.) into a hard config-load
+	// failure for setups that worked fine before token rotation existed.
+	if token != "" && sdc.TokenFile != "" {
+		if err := preflightToken(client, sdc.TokenPreflightTimeout); err != nil {
+			return nil, err
+		}
+	}
 	tagSeparator := ","
 	if sdc.TagSeparator != nil {
 		tagSeparator = *sdc.TagSeparator
@@ -82,24 +104,88 @@ func newAPIConfig(sdc *SDConfig, baseDir string) (*apiConfig, error) {
 		return nil, err
 	}
 
-	cw := newConsulWatcher(client, sdc, dc)
+	namespaces := []string{sdc.Namespace}
+	if sdc.Namespace == "*" {
+		ns, err := getNamespaces(client)
+		if err != nil {
+			logger.Warnf("cannot enumerate Consul Enterprise namespaces via /v1/namespaces (namespace=\"*\" requires "+
+				"Consul Enterprise); falling back to the default namespace: %s", err)
+			namespaces = []string{""}
+		} else {
+			namespaces = ns
+		}
+	}
+	ch := newClientHolder(client)
+	cws := make([]*consulWatcher, len(namespaces))
+	for i, ns := range namespaces {
+		cws[i] = newConsulWatcher(ch, sdc, dc, ns, sdc.Partition)
+	}
 	cfg := &apiConfig{
-		tagSeparator:  tagSeparator,
-		consulWatcher: cw,
+		tagSeparator:   tagSeparator,
+		consulWatchers: cws,
+		tokenRenewer:   startTokenRenewer(ch, sdc, baseDir, apiServer, ba, proxyAC, token),
 	}
 	return cfg, nil
 }
 
-func getToken(token *string) (string, error) {
+// appendEnterpriseQueryArgs appends Consul Enterprise namespace/partition selectors to path
+// as ns= and partition= query args when they are set. This is a no-op against Consul OSS.
+func appendEnterpriseQueryArgs(path, namespace, partition string) string {
+	if namespace != "" && namespace != "*" {
+		path += "&ns=" + namespace
+	}
+	if partition != "" {
+		path += "&partition=" + partition
+	}
+	return path
+}
+
+// consulNamespace is a single entry returned by /v1/namespaces.
+type consulNamespace struct {
+	Name string
+}
+
+// getNamespaces returns the names of all Consul Enterprise namespaces visible to the configured token.
+//
+// See https://www.consul.io/api-docs/namespaces#list-all-namespaces
+func getNamespaces(client *discoveryutils.Client) ([]string, error) {
+	data, err := client.GetAPIResponse("/v1/namespaces")
+	if err != nil {
+		return nil, fmt.Errorf("cannot query consul namespaces: %w", err)
+	}
+	var namespaces []consulNamespace
+	if err := json.Unmarshal(data, &namespaces); err != nil {
+		return nil, fmt.Errorf("cannot parse response from /v1/namespaces: %w", err)
+	}
+	names := make([]string, len(namespaces))
+	for i, ns := range namespaces {
+		names[i] = ns.Name
+	}
+	return names, nil
+}
+
+func getToken(sdc *SDConfig) (string, error) {
+	return GetToken(sdc.Token, sdc.TokenFile)
+}
+
+// GetToken resolves a Consul ACL token from an explicit token, a token file, or the
+// CONSUL_HTTP_TOKEN_FILE/CONSUL_HTTP_TOKEN environment variables, in that order.
+//
+// It is exported so that other discovery packages backed by the same Consul agent
+// (e.g. lib/promscrape/discovery/consulkv) can resolve tokens the same way.
+func GetToken(token *string, tokenFile string) (string, error) {
 	if token != nil {
 		return *token, nil
 	}
-	if tokenFile := os.Getenv("CONSUL_HTTP_TOKEN_FILE"); tokenFile != "" {
+	if tokenFile == "" {
+		tokenFile = os.Getenv("CONSUL_HTTP_TOKEN_FILE")
+	}
+	if tokenFile != "" {
 		data, err := ioutil.ReadFile(tokenFile)
 		if err != nil {
 			return "", fmt.Errorf("cannot read consul token file %q; probably, `token` arg is missing in `consul_sd_config`? error: %w", tokenFile, err)
 		}
-		return string(data), nil
+		return strings.TrimSpace(string(data)), nil
 	}
 	t := os.Getenv("CONSUL_HTTP_TOKEN")
 	// Allow empty token - it shouls work if authorization is disabled in Consul
@@ -138,37 +224,77 @@ func maxWaitTime() time.Duration {
 	return d
 }
 
-// getBlockingAPIResponse perfoms blocking request to Consul via client and returns response.
+func getBlockingAPIResponse(client *discoveryutils.Client, path string, index int64, allowStale, requireConsistent bool, maxStaleness time.Duration) ([]byte, int64, error) {
+	return GetBlockingAPIResponse(client, path, index, allowStale, requireConsistent, maxStaleness)
+}
+
+// GetBlockingAPIResponse perfoms blocking request to Consul via client and returns response.
+//
+// allowStale and requireConsistent select the consistency mode of the query as described at
+// https://www.consul.io/api-docs/features/consistency . When the response turns out to come from
+// a follower that doesn't know the current leader, or lags the leader by more than maxStaleness,
+// it is discarded and the request is retried without advancing index, so callers never observe
+// a negative result cached by a lagging follower.
+//
+// It is exported so that other discovery packages backed by the same Consul agent
+// (e.g. lib/promscrape/discovery/consulkv) can reuse the same blocking-query/index/consistency
+// semantics instead of reimplementing them.
 //
 // See https://www.consul.io/api-docs/features/blocking .
-func getBlockingAPIResponse(client *discoveryutils.Client, path string, index int64) ([]byte, int64, error) {
-	path += "&index=" + strconv.FormatInt(index, 10)
-	path += "&wait=" + fmt.Sprintf("%ds", int(maxWaitTime().Seconds()))
-	getMeta := func(resp *fasthttp.Response) {
-		ind := resp.Header.Peek("X-Consul-Index")
-		if len(ind) == 0 {
-			logger.Errorf("cannot find X-Consul-Index header in response from %q", path)
-			return
+func GetBlockingAPIResponse(client *discoveryutils.Client, path string, index int64, allowStale, requireConsistent bool, maxStaleness time.Duration) ([]byte, int64, error) {
+	if requireConsistent {
+		path += "&consistent"
+	} else if allowStale {
+		path += "&stale"
+	}
+	basePath := path + "&index=" + strconv.FormatInt(index, 10)
+	basePath += "&wait=" + fmt.Sprintf("%ds", int(maxWaitTime().Seconds()))
+	for {
+		newIndex := index
+		var isStale bool
+		getMeta := func(resp *fasthttp.Response) {
+			ind := resp.Header.Peek("X-Consul-Index")
+			if len(ind) == 0 {
+				logger.Errorf("cannot find X-Consul-Index header in response from %q", basePath)
+				return
+			}
+			n, err := strconv.ParseInt(string(ind), 10, 64)
+			if err != nil {
+				logger.Errorf("cannot parse X-Consul-Index header value in response from %q: %s", basePath, err)
+				return
+			}
+			// Properly handle the returned newIndex according to https://www.consul.io/api-docs/features/blocking#implementation-details
+			if n < 1 {
+				newIndex = 1
+			} else if index > n {
+				newIndex = 0
+			} else {
+				newIndex = n
+			}
+			if string(resp.Header.Peek("X-Consul-KnownLeader")) == "false" {
+				isStale = true
+			}
+			if lc := resp.Header.Peek("X-Consul-LastContact"); len(lc) > 0 {
+				ms, err := strconv.ParseInt(string(lc), 10, 64)
+				if err != nil {
+					logger.Errorf("cannot parse X-Consul-LastContact header value in response from %q: %s", basePath, err)
+				} else if time.Duration(ms)*time.Millisecond > maxStaleness {
+					isStale = true
+				}
+			}
 		}
-		newIndex, err := strconv.ParseInt(string(ind), 10, 64)
+		data, err := client.GetBlockingAPIResponse(basePath, getMeta)
 		if err != nil {
-			logger.Errorf("cannot parse X-Consul-Index header value in response from %q: %s", path, err)
-			return
-		}
-		// Properly handle the returned newIndex according to https://www.consul.io/api-docs/features/blocking#implementation-details
-		if newIndex < 1 {
-			index = 1
-			return
+			return nil, index, fmt.Errorf("cannot perform blocking Consul API request at %q: %w", basePath, err)
 		}
-		if index > newIndex {
-			index = 0
-			return
+		if isStale {
+			logger.Warnf("discarding stale Consul response from %q served by a follower without a known leader or lagging by more than max_staleness=%s; retrying", basePath, maxStaleness)
+			// A follower missing a known leader answers immediately instead of actually blocking on
+			// index, so without a delay here a partitioned or persistently-lagging cluster would be
+			// hammered by this loop instead of backing off.
+			time.Sleep(staleRetryDelay)
+			continue
 		}
-		index = newIndex
-	}
-	data, err := client.GetBlockingAPIResponse(path, getMeta)
-	if err != nil {
-		return nil, index, fmt.Errorf("cannot perform blocking Consul API request at %q: %w", path, err)
+		return data, newIndex, nil
 	}
-	return data, index, nil
 }
@@ -0,0 +1,154 @@
+package consul
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/promauth"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/promscrape/discoveryutils"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/proxy"
+)
+
+// SDConfig represents service discovery config for consul.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#consul_sd_config
+type SDConfig struct {
+	Server     string  `yaml:"server,omitempty"`
+	Token      *string `yaml:"token"`
+	Datacenter string  `yaml:"datacenter"`
+
+	// TokenFile points to a file holding the Consul ACL token. Unlike Token, the file is watched
+	// and the in-use token is rotated transparently, which is required for short-lived tokens
+	// issued e.g. by Vault's consul secrets engine or a Workload Identity login.
+	TokenFile string `yaml:"token_file,omitempty"`
+	// TokenRenewInterval is how often TokenFile's mtime (and the token's ExpirationTime, via
+	// /v1/acl/token/self) is checked for rotation. Defaults to 30s.
+	TokenRenewInterval string `yaml:"token_renew_interval,omitempty"`
+	// TokenPreflightTimeout bounds how long a freshly-(re)loaded TokenFile token is retried against
+	// /v1/acl/token/self on the local agent before giving up. It only applies to TokenFile-sourced
+	// tokens, since those are the only ones that can be newly-issued and not yet replicated to the
+	// local agent; it has no effect on a static Token or a token picked up from CONSUL_HTTP_TOKEN.
+	// Defaults to 10s.
+	TokenPreflightTimeout string `yaml:"token_preflight_timeout,omitempty"`
+
+	// Namespace selects the Consul Enterprise namespace to query.
+	//
+	// A value of "*" watches every namespace returned by /v1/namespaces and merges their targets
+	// into a single job. This requires Consul Enterprise: /v1/namespaces doesn't exist on Consul
+	// OSS, so "*" falls back to watching the default namespace there.
+	Namespace string `yaml:"namespace,omitempty"`
+	// Partition selects the Consul Enterprise admin partition to query.
+	//
+	// This has no effect against Consul OSS.
+	Partition string `yaml:"partition,omitempty"`
+
+	Scheme       string            `yaml:"scheme,omitempty"`
+	Username     string            `yaml:"username"`
+	Password     string            `yaml:"password"`
+	NodeMeta     map[string]string `yaml:"node_meta,omitempty"`
+	TagSeparator *string           `yaml:"tag_separator,omitempty"`
+	Services     []string          `yaml:"services,omitempty"`
+	Tags         []string          `yaml:"tags,omitempty"`
+
+	// Connect switches the watcher from the plain service catalog to Consul's Connect (service
+	// mesh) catalog, so it discovers mesh sidecar proxies instead of the services they front.
+	Connect bool `yaml:"connect,omitempty"`
+
+	// AllowStale allows any Consul server (not just the leader) to answer blocking queries.
+	// It is true by default, mirroring Consul's own default consistency mode.
+	AllowStale *bool `yaml:"allow_stale,omitempty"`
+	// RequireConsistent forces every blocking query to be served by the current leader.
+	// It takes precedence over AllowStale when both are set and costs more load on the Consul servers.
+	RequireConsistent bool `yaml:"require_consistent,omitempty"`
+	// MaxStaleness bounds how far behind the leader a stale response is allowed to be, e.g. "150s".
+	// Responses served by a follower that doesn't know the current leader, or whose X-Consul-LastContact
+	// exceeds this value, are discarded and the blocking query is retried without advancing its index.
+	// Defaults to 150s.
+	MaxStaleness string `yaml:"max_staleness,omitempty"`
+
+	TLSConfig         *promauth.TLSConfig        `yaml:"tls_config,omitempty"`
+	ProxyURL          proxy.URL                  `yaml:"proxy_url,omitempty"`
+	ProxyClientConfig promauth.ProxyClientConfig `yaml:",inline"`
+}
+
+// GetLabels returns Consul labels according to sdc.
+func GetLabels(sdc *SDConfig, baseDir string) ([]map[string]string, error) {
+	cfg, err := getAPIConfig(sdc, baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get API config: %w", err)
+	}
+	return cfg.getLabels(), nil
+}
+
+func (ac *apiConfig) getLabels() []map[string]string {
+	var ms []map[string]string
+	for _, cw := range ac.consulWatchers {
+		ms = cw.appendTargetLabels(ms)
+	}
+	return ms
+}
+
+func (cw *consulWatcher) appendTargetLabels(ms []map[string]string) []map[string]string {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	for svc, nodes := range cw.serviceNodes {
+		for _, n := range nodes {
+			addr := net.JoinHostPort(n.ServiceAddressOrDefault(), strconv.Itoa(n.ServicePort))
+			m := map[string]string{
+				"__address__":                   addr,
+				"__meta_consul_address":         n.Address,
+				"__meta_consul_dc":              cw.datacenter,
+				"__meta_consul_health":          n.Status,
+				"__meta_consul_node":            n.Node,
+				"__meta_consul_service":         svc,
+				"__meta_consul_service_address": n.ServiceAddress,
+				"__meta_consul_service_id":      n.ServiceID,
+				"__meta_consul_service_port":    fmt.Sprintf("%d", n.ServicePort),
+				"__meta_consul_tags":            cw.joinTags(n.ServiceTags),
+			}
+			if cw.namespace != "" {
+				m["__meta_consul_namespace"] = cw.namespace
+			}
+			if cw.partition != "" {
+				m["__meta_consul_partition"] = cw.partition
+			}
+			for k, v := range n.NodeMeta {
+				m[discoveryutils.SanitizeLabelName("__meta_consul_metadata_"+k)] = v
+			}
+			for k, v := range n.ServiceMeta {
+				m[discoveryutils.SanitizeLabelName("__meta_consul_service_metadata_"+k)] = v
+			}
+			if cw.sdc.Connect {
+				m["__meta_consul_connect_destination_service_name"] = n.ServiceProxy.DestinationServiceName
+				m["__meta_consul_connect_local_service_port"] = fmt.Sprintf("%d", n.ServiceProxy.LocalServicePort)
+				if chain := cw.discoveryChains[svc]; chain != nil {
+					m["__meta_consul_connect_target_service"] = chain.TargetService
+					m["__meta_consul_connect_target_datacenter"] = chain.TargetDatacenter
+					m["__meta_consul_connect_target_subset"] = chain.TargetSubset
+					for upstream, target := range chain.Upstreams {
+						m[discoveryutils.SanitizeLabelName("__meta_consul_connect_upstream_"+upstream)] = target
+					}
+				}
+			}
+			ms = append(ms, m)
+		}
+	}
+	return ms
+}
+
+func (cw *consulWatcher) joinTags(tags []string) string {
+	sep := cw.tagSeparator
+	if sep == "" {
+		sep = ","
+	}
+	s := ""
+	for i, t := range tags {
+		if i > 0 {
+			s += sep
+		}
+		s += t
+	}
+	return sep + s + sep
+}
@@ -0,0 +1,258 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/promscrape/discoveryutils"
+)
+
+// defaultMaxStaleness is the default upper bound on how far a stale Consul response may lag the leader.
+const defaultMaxStaleness = 150 * time.Second
+
+// ServiceNode is a single entry returned by /v1/catalog/service/<name>, or, when Connect is
+// enabled, by /v1/catalog/connect/<name>.
+//
+// See https://www.consul.io/api-docs/catalog#list-nodes-for-service
+type ServiceNode struct {
+	Node           string
+	Address        string
+	NodeMeta       map[string]string
+	ServiceID      string
+	ServiceName    string
+	ServiceAddress string
+	ServiceTags    []string
+	ServiceMeta    map[string]string
+	ServicePort    int
+	ServiceProxy   ServiceProxy
+	Status         string
+}
+
+// ServiceProxy holds the subset of a Connect sidecar's proxy config that is useful for relabeling
+// scrapes onto the mesh-terminated port.
+//
+// See https://www.consul.io/docs/connect/registration/service-registration#complete-configuration-reference
+type ServiceProxy struct {
+	DestinationServiceName string
+	LocalServicePort       int
+}
+
+// ServiceAddressOrDefault returns sn.ServiceAddress if it is set, otherwise it falls back to sn.Address.
+func (sn *ServiceNode) ServiceAddressOrDefault() string {
+	if sn.ServiceAddress != "" {
+		return sn.ServiceAddress
+	}
+	return sn.Address
+}
+
+// consulWatcher watches for Consul catalog changes for a single namespace/partition pair.
+type consulWatcher struct {
+	client       *clientHolder
+	sdc          *SDConfig
+	datacenter   string
+	namespace    string
+	partition    string
+	tagSeparator string
+
+	allowStale        bool
+	requireConsistent bool
+	maxStaleness      time.Duration
+
+	mu              sync.Mutex
+	serviceNodes    map[string][]ServiceNode
+	discoveryChains map[string]*discoveryChainInfo
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// newConsulWatcher starts watching the configured services in the given namespace/partition
+// and returns a watcher whose snapshot is kept up to date in the background.
+func newConsulWatcher(client *clientHolder, sdc *SDConfig, datacenter, namespace, partition string) *consulWatcher {
+	tagSeparator := ","
+	if sdc.TagSeparator != nil {
+		tagSeparator = *sdc.TagSeparator
+	}
+	allowStale := true
+	if sdc.AllowStale != nil {
+		allowStale = *sdc.AllowStale
+	}
+	maxStaleness := defaultMaxStaleness
+	if sdc.MaxStaleness != "" {
+		d, err := time.ParseDuration(sdc.MaxStaleness)
+		if err != nil {
+			logger.Errorf("cannot parse max_staleness=%q; using the default %s: %s", sdc.MaxStaleness, defaultMaxStaleness, err)
+		} else {
+			maxStaleness = d
+		}
+	}
+	cw := &consulWatcher{
+		client:            client,
+		sdc:               sdc,
+		datacenter:        datacenter,
+		namespace:         namespace,
+		partition:         partition,
+		tagSeparator:      tagSeparator,
+		allowStale:        allowStale,
+		requireConsistent: sdc.RequireConsistent,
+		maxStaleness:      maxStaleness,
+		serviceNodes:      make(map[string][]ServiceNode),
+		discoveryChains:   make(map[string]*discoveryChainInfo),
+		stopCh:            make(chan struct{}),
+	}
+	for _, service := range sdc.Services {
+		cw.wg.Add(1)
+		go func(service string) {
+			defer cw.wg.Done()
+			cw.watchForServiceNodesUpdates(service)
+		}(service)
+	}
+	return cw
+}
+
+func (cw *consulWatcher) mustStop() {
+	close(cw.stopCh)
+	cw.wg.Wait()
+}
+
+func (cw *consulWatcher) watchForServiceNodesUpdates(service string) {
+	var index int64
+	path := cw.serviceNodesQueryPath(service)
+	for {
+		select {
+		case <-cw.stopCh:
+			return
+		default:
+		}
+		data, newIndex, err := getBlockingAPIResponse(cw.client.Get(), path, index, cw.allowStale, cw.requireConsistent, cw.maxStaleness)
+		if err != nil {
+			logger.Errorf("error when performing blocking Consul API request for service nodes at %q: %s", path, err)
+			continue
+		}
+		index = newIndex
+		nodes, err := parseServiceNodes(data)
+		if err != nil {
+			logger.Errorf("cannot parse Consul service nodes response for service %q: %s", service, err)
+			continue
+		}
+		var chain *discoveryChainInfo
+		if cw.sdc.Connect {
+			chain, err = getDiscoveryChain(cw.client.Get(), service, cw.datacenter, cw.namespace, cw.partition)
+			if err != nil {
+				logger.Errorf("cannot fetch Consul discovery chain for service %q: %s", service, err)
+			}
+		}
+		cw.mu.Lock()
+		cw.serviceNodes[service] = nodes
+		if chain != nil {
+			cw.discoveryChains[service] = chain
+		}
+		cw.mu.Unlock()
+	}
+}
+
+func (cw *consulWatcher) serviceNodesQueryPath(service string) string {
+	endpoint := "service"
+	if cw.sdc.Connect {
+		endpoint = "connect"
+	}
+	path := fmt.Sprintf("/v1/catalog/%s/%s?dc=%s", endpoint, service, cw.datacenter)
+	path = appendEnterpriseQueryArgs(path, cw.namespace, cw.partition)
+	return path
+}
+
+// discoveryChainInfo is the subset of a compiled discovery chain (/v1/discovery-chain/<service>)
+// needed for Connect target/upstream labels.
+//
+// See https://www.consul.io/api-docs/discovery-chain
+type discoveryChainInfo struct {
+	TargetService    string
+	TargetDatacenter string
+	TargetSubset     string
+	// Upstreams maps the key of every other target in the compiled chain's targets map to
+	// "<service>.<datacenter>". Keys are stored as-is; they are sanitized when turned into labels.
+	Upstreams map[string]string
+}
+
+type discoveryChainTarget struct {
+	Service    string
+	Datacenter string
+	Subset     string
+}
+
+type discoveryChainResponse struct {
+	Chain struct {
+		ServiceName string
+		Targets     map[string]discoveryChainTarget
+	}
+}
+
+func getDiscoveryChain(client *discoveryutils.Client, service, datacenter, namespace, partition string) (*discoveryChainInfo, error) {
+	path := fmt.Sprintf("/v1/discovery-chain/%s?dc=%s", service, datacenter)
+	path = appendEnterpriseQueryArgs(path, namespace, partition)
+	data, err := client.GetAPIResponse(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query discovery chain at %q: %w", path, err)
+	}
+	var resp discoveryChainResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("cannot parse discovery chain response from %q: %w", path, err)
+	}
+	return buildDiscoveryChainInfo(&resp), nil
+}
+
+// primaryDiscoveryChainTarget deterministically picks the key in targets that identifies "the"
+// resolved target for serviceName, out of every entry matching Service==serviceName && Subset=="".
+//
+// Multiple targets can match (e.g. failover targets for the same service in other datacenters), so
+// this picks the lexicographically smallest key instead of whichever map iteration happens to visit
+// first - Go map iteration order is randomized, which would otherwise make these labels flap between
+// discovery cycles with no underlying change in Consul. It returns "" if nothing matches.
+func primaryDiscoveryChainTarget(targets map[string]discoveryChainTarget, serviceName string) string {
+	var candidateKeys []string
+	for key, t := range targets {
+		if t.Service == serviceName && t.Subset == "" {
+			candidateKeys = append(candidateKeys, key)
+		}
+	}
+	sort.Strings(candidateKeys)
+	if len(candidateKeys) == 0 {
+		return ""
+	}
+	return candidateKeys[0]
+}
+
+func buildDiscoveryChainInfo(resp *discoveryChainResponse) *discoveryChainInfo {
+	primaryKey := primaryDiscoveryChainTarget(resp.Chain.Targets, resp.Chain.ServiceName)
+
+	info := &discoveryChainInfo{
+		Upstreams: make(map[string]string),
+	}
+	if primaryKey != "" {
+		t := resp.Chain.Targets[primaryKey]
+		info.TargetService = t.Service
+		info.TargetDatacenter = t.Datacenter
+		info.TargetSubset = t.Subset
+	} else {
+		info.TargetService = resp.Chain.ServiceName
+	}
+	for key, t := range resp.Chain.Targets {
+		if key == primaryKey {
+			continue
+		}
+		info.Upstreams[key] = fmt.Sprintf("%s.%s", t.Service, t.Datacenter)
+	}
+	return info
+}
+
+func parseServiceNodes(data []byte) ([]ServiceNode, error) {
+	var nodes []ServiceNode
+	if err := json.Unmarshal(data, &nodes); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal %q: %w", data, err)
+	}
+	return nodes, nil
+}
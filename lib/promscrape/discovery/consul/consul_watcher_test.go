@@ -0,0 +1,64 @@
+package consul
+
+import (
+	"testing"
+)
+
+func TestPrimaryDiscoveryChainTarget(t *testing.T) {
+	f := func(targets map[string]discoveryChainTarget, serviceName, expectedKey string) {
+		t.Helper()
+		for i := 0; i < 10; i++ {
+			key := primaryDiscoveryChainTarget(targets, serviceName)
+			if key != expectedKey {
+				t.Fatalf("unexpected primary target key; got %q; want %q", key, expectedKey)
+			}
+		}
+	}
+
+	// No targets at all.
+	f(map[string]discoveryChainTarget{}, "foo", "")
+
+	// A single matching target.
+	f(map[string]discoveryChainTarget{
+		"foo.default.dc1": {Service: "foo", Datacenter: "dc1"},
+	}, "foo", "foo.default.dc1")
+
+	// A subset target doesn't count as the primary target.
+	f(map[string]discoveryChainTarget{
+		"foo.canary.dc1": {Service: "foo", Datacenter: "dc1", Subset: "canary"},
+	}, "foo", "")
+
+	// Multiple matching targets (e.g. failover targets for the same service in other
+	// datacenters) must resolve deterministically to the lexicographically smallest key,
+	// regardless of map iteration order.
+	f(map[string]discoveryChainTarget{
+		"foo.default.dc2": {Service: "foo", Datacenter: "dc2"},
+		"foo.default.dc1": {Service: "foo", Datacenter: "dc1"},
+		"bar.default.dc1": {Service: "bar", Datacenter: "dc1"},
+	}, "foo", "foo.default.dc1")
+}
+
+func TestBuildDiscoveryChainInfo(t *testing.T) {
+	resp := &discoveryChainResponse{}
+	resp.Chain.ServiceName = "foo"
+	resp.Chain.Targets = map[string]discoveryChainTarget{
+		"foo.default.dc2": {Service: "foo", Datacenter: "dc2"},
+		"foo.default.dc1": {Service: "foo", Datacenter: "dc1"},
+		"bar.default.dc1": {Service: "bar", Datacenter: "dc1"},
+	}
+
+	info := buildDiscoveryChainInfo(resp)
+	if info.TargetService != "foo" || info.TargetDatacenter != "dc1" {
+		t.Fatalf("unexpected primary target; got service=%q datacenter=%q; want service=foo datacenter=dc1",
+			info.TargetService, info.TargetDatacenter)
+	}
+	if _, ok := info.Upstreams["foo.default.dc1"]; ok {
+		t.Fatalf("the primary target must not also appear as an upstream")
+	}
+	if got, want := info.Upstreams["foo.default.dc2"], "foo.dc2"; got != want {
+		t.Fatalf("unexpected upstream for foo.default.dc2; got %q; want %q", got, want)
+	}
+	if got, want := info.Upstreams["bar.default.dc1"], "bar.dc1"; got != want {
+		t.Fatalf("unexpected upstream for bar.default.dc1; got %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,63 @@
+package consul
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/promscrape/discoveryutils"
+)
+
+// defaultTokenPreflightTimeout bounds how long preflightToken retries against the local agent
+// when SDConfig.TokenPreflightTimeout isn't set.
+const defaultTokenPreflightTimeout = 10 * time.Second
+
+// preflightToken retries GET /v1/acl/token/self?stale against the configured agent until it
+// returns 200 or timeout elapses.
+//
+// Local Consul agents answer ACL lookups in stale consistency mode and cache negative results,
+// so a token created moments earlier on a different server may not have replicated yet. A single
+// successful stale read here primes the agent's cache and avoids a cached miss poisoning every
+// subsequent watcher request.
+func preflightToken(client *discoveryutils.Client, timeoutStr string) error {
+	timeout := defaultTokenPreflightTimeout
+	if timeoutStr != "" {
+		d, err := time.ParseDuration(timeoutStr)
+		if err != nil {
+			return fmt.Errorf("cannot parse token_preflight_timeout=%q: %w", timeoutStr, err)
+		}
+		timeout = d
+	}
+	err := retryWithBackoff(timeout, func() error {
+		_, err := client.GetAPIResponse("/v1/acl/token/self?stale")
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("consul agent didn't recognize the configured ACL token within token_preflight_timeout=%s, "+
+			"probably because it hasn't replicated from the server that issued it yet: %w", timeout, err)
+	}
+	return nil
+}
+
+// retryWithBackoff calls get with exponential backoff, starting at 100ms and doubling up to a cap
+// of 1s between attempts, until it returns nil or timeout elapses. It returns get's last error on
+// timeout.
+func retryWithBackoff(timeout time.Duration, get func() error) error {
+	deadline := time.Now().Add(timeout)
+	backoff := 100 * time.Millisecond
+	var lastErr error
+	for {
+		err := get()
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if time.Now().After(deadline) {
+			return lastErr
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > time.Second {
+			backoff = time.Second
+		}
+	}
+}
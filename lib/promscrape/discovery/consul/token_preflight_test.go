@@ -0,0 +1,39 @@
+package consul
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryWithBackoffSucceedsAfterTransientErrors(t *testing.T) {
+	attempts := 0
+	err := retryWithBackoff(time.Second, func() error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("not ready yet")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("unexpected number of attempts; got %d; want 3", attempts)
+	}
+}
+
+func TestRetryWithBackoffGivesUpAfterTimeout(t *testing.T) {
+	attempts := 0
+	wantErr := errors.New("still failing")
+	err := retryWithBackoff(150*time.Millisecond, func() error {
+		attempts++
+		return wantErr
+	})
+	if !errors.Is(err, wantErr) {
+		t.Fatalf("unexpected error; got %v; want %v", err, wantErr)
+	}
+	if attempts < 2 {
+		t.Fatalf("expected at least one retry before giving up; got %d attempts", attempts)
+	}
+}
@@ -0,0 +1,183 @@
+package consul
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/promauth"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/promscrape/discoveryutils"
+)
+
+// defaultTokenRenewInterval is how often a configured TokenFile is checked for rotation
+// when SDConfig.TokenRenewInterval isn't set.
+const defaultTokenRenewInterval = 30 * time.Second
+
+// tokenExpirationBuffer is how far ahead of a token's ExpirationTime it is renewed.
+const tokenExpirationBuffer = 30 * time.Second
+
+// clientHolder lets the token renewer swap the *discoveryutils.Client used for Consul API
+// requests without restarting the watchers that hold a reference to it: discoveryutils.Client
+// has no setter for its auth config, so a rotated token is applied by building a brand new
+// client and atomically publishing it here.
+type clientHolder struct {
+	v atomic.Value
+}
+
+func newClientHolder(client *discoveryutils.Client) *clientHolder {
+	ch := &clientHolder{}
+	ch.v.Store(client)
+	return ch
+}
+
+func (ch *clientHolder) Get() *discoveryutils.Client {
+	return ch.v.Load().(*discoveryutils.Client)
+}
+
+func (ch *clientHolder) Set(client *discoveryutils.Client) {
+	ch.v.Store(client)
+}
+
+// tokenRenewer keeps the client behind a clientHolder in sync with sdc.TokenFile, so short-lived
+// Consul ACL tokens don't make the scraper start getting 403s once they expire.
+type tokenRenewer struct {
+	client    *clientHolder
+	sdc       *SDConfig
+	baseDir   string
+	ba        *promauth.BasicAuthConfig
+	apiServer string
+	proxyAC   *promauth.Config
+
+	interval    time.Duration
+	lastModTime time.Time
+	lastToken   string
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// startTokenRenewer starts watching sdc.TokenFile for rotation, if one is configured.
+// It always returns a non-nil *tokenRenewer so that apiConfig.mustStop can call it unconditionally.
+func startTokenRenewer(client *clientHolder, sdc *SDConfig, baseDir, apiServer string, ba *promauth.BasicAuthConfig, proxyAC *promauth.Config, initialToken string) *tokenRenewer {
+	interval := defaultTokenRenewInterval
+	if sdc.TokenRenewInterval != "" {
+		d, err := time.ParseDuration(sdc.TokenRenewInterval)
+		if err != nil {
+			logger.Errorf("cannot parse token_renew_interval=%q; using the default %s: %s", sdc.TokenRenewInterval, defaultTokenRenewInterval, err)
+		} else {
+			interval = d
+		}
+	}
+	tr := &tokenRenewer{
+		client:    client,
+		sdc:       sdc,
+		baseDir:   baseDir,
+		ba:        ba,
+		apiServer: apiServer,
+		proxyAC:   proxyAC,
+		interval:  interval,
+		lastToken: initialToken,
+		stopCh:    make(chan struct{}),
+	}
+	if sdc.TokenFile == "" {
+		return tr
+	}
+	tr.wg.Add(1)
+	go func() {
+		defer tr.wg.Done()
+		tr.run()
+	}()
+	return tr
+}
+
+func (tr *tokenRenewer) mustStop() {
+	if tr == nil {
+		return
+	}
+	close(tr.stopCh)
+	tr.wg.Wait()
+}
+
+func (tr *tokenRenewer) run() {
+	ticker := time.NewTicker(tr.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-tr.stopCh:
+			return
+		case <-ticker.C:
+			tr.maybeRenew()
+		}
+	}
+}
+
+func (tr *tokenRenewer) maybeRenew() {
+	fi, err := os.Stat(tr.sdc.TokenFile)
+	if err != nil {
+		logger.Errorf("cannot stat consul token_file=%q: %s", tr.sdc.TokenFile, err)
+		return
+	}
+	fileChanged := fi.ModTime().After(tr.lastModTime)
+	expiringSoon := !fileChanged && tr.isExpiringSoon()
+	if !fileChanged && !expiringSoon {
+		return
+	}
+	data, err := ioutil.ReadFile(tr.sdc.TokenFile)
+	if err != nil {
+		logger.Errorf("cannot read consul token_file=%q: %s", tr.sdc.TokenFile, err)
+		return
+	}
+	token := strings.TrimSpace(string(data))
+	tr.lastModTime = fi.ModTime()
+	if token == tr.lastToken {
+		if expiringSoon {
+			logger.Warnf("consul ACL token is expiring soon, but token_file=%q still holds the same token; "+
+				"it needs to be rewritten with a fresh token before it expires", tr.sdc.TokenFile)
+		}
+		return
+	}
+	ac, err := promauth.NewConfig(tr.baseDir, nil, tr.ba, token, "", nil, tr.sdc.TLSConfig)
+	if err != nil {
+		logger.Errorf("cannot build auth config for rotated consul token_file=%q: %s", tr.sdc.TokenFile, err)
+		return
+	}
+	client, err := discoveryutils.NewClient(tr.apiServer, ac, tr.sdc.ProxyURL, tr.proxyAC)
+	if err != nil {
+		logger.Errorf("cannot create HTTP client for rotated consul token_file=%q: %s", tr.sdc.TokenFile, err)
+		return
+	}
+	if err := preflightToken(client, tr.sdc.TokenPreflightTimeout); err != nil {
+		logger.Errorf("newly-rotated Consul ACL token from token_file=%q failed preflight; keeping the previous token in use: %s", tr.sdc.TokenFile, err)
+		return
+	}
+	tr.client.Set(client)
+	tr.lastToken = token
+	logger.Infof("successfully rotated Consul ACL token from token_file=%q", tr.sdc.TokenFile)
+}
+
+// isExpiringSoon queries /v1/acl/token/self and reports whether the in-use token's ExpirationTime
+// is within tokenExpirationBuffer, so rotation can happen slightly ahead of the token_file mtime
+// check picking up a file the operator hasn't written yet.
+func (tr *tokenRenewer) isExpiringSoon() bool {
+	data, err := tr.client.Get().GetAPIResponse("/v1/acl/token/self")
+	if err != nil {
+		// The current token may already be invalid; let the mtime check above drive renewal.
+		return false
+	}
+	var info struct {
+		ExpirationTime time.Time
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		logger.Errorf("cannot parse /v1/acl/token/self response: %s", err)
+		return false
+	}
+	if info.ExpirationTime.IsZero() {
+		return false
+	}
+	return time.Until(info.ExpirationTime) < tokenExpirationBuffer
+}
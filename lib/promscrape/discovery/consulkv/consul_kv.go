@@ -0,0 +1,49 @@
+package consulkv
+
+import (
+	"fmt"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/promauth"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/proxy"
+)
+
+// SDConfig represents service discovery config for consul_kv_sd_config.
+//
+// Unlike consul_sd_config, this watches a Consul KV prefix instead of the service catalog,
+// so it can register arbitrary targets (batch jobs, cron nodes, static appliances) that
+// aren't backed by a Consul service.
+//
+// It is wired into scrape_configs via ScrapeConfig.ConsulKVSDConfigs in lib/promscrape/config.go.
+type SDConfig struct {
+	Server     string  `yaml:"server,omitempty"`
+	Token      *string `yaml:"token"`
+	Datacenter string  `yaml:"datacenter"`
+	Namespace  string  `yaml:"namespace,omitempty"`
+	Partition  string  `yaml:"partition,omitempty"`
+	Scheme     string  `yaml:"scheme,omitempty"`
+	Username   string  `yaml:"username"`
+	Password   string  `yaml:"password"`
+
+	// Prefix is the KV path prefix to recursively watch, e.g. "targets/".
+	Prefix string `yaml:"prefix"`
+
+	// AllowStale and RequireConsistent select the consistency mode of the blocking KV query,
+	// and MaxStaleness bounds how far behind the leader a stale response is allowed to be.
+	// These mirror the same-named options in consul_sd_config.
+	AllowStale        *bool  `yaml:"allow_stale,omitempty"`
+	RequireConsistent bool   `yaml:"require_consistent,omitempty"`
+	MaxStaleness      string `yaml:"max_staleness,omitempty"`
+
+	TLSConfig         *promauth.TLSConfig        `yaml:"tls_config,omitempty"`
+	ProxyURL          proxy.URL                  `yaml:"proxy_url,omitempty"`
+	ProxyClientConfig promauth.ProxyClientConfig `yaml:",inline"`
+}
+
+// GetLabels returns Consul KV labels according to sdc.
+func GetLabels(sdc *SDConfig, baseDir string) ([]map[string]string, error) {
+	cfg, err := getAPIConfig(sdc, baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get API config: %w", err)
+	}
+	return cfg.kvWatcher.getLabels(), nil
+}
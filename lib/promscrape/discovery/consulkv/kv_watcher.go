@@ -0,0 +1,185 @@
+package consulkv
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/promscrape/discovery/consul"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/promscrape/discoveryutils"
+)
+
+// defaultMaxStaleness mirrors the default in lib/promscrape/discovery/consul.
+const defaultMaxStaleness = 150 * time.Second
+
+// kvPair is a single entry returned by /v1/kv/<prefix>?recurse.
+//
+// See https://www.consul.io/api-docs/kv#read-key
+type kvPair struct {
+	Key   string
+	Value string
+}
+
+// kvValue is the shape of a KV value when it is stored as a JSON object instead of a plain
+// "host:port" string.
+type kvValue struct {
+	Address string            `json:"address"`
+	Port    int               `json:"port"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// kvWatcher blocking-watches a Consul KV prefix and keeps a snapshot of its entries.
+type kvWatcher struct {
+	client *discoveryutils.Client
+	sdc    *SDConfig
+	path   string
+
+	allowStale        bool
+	requireConsistent bool
+	maxStaleness      time.Duration
+
+	mu      sync.Mutex
+	entries map[string]kvPair
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newKVWatcher(client *discoveryutils.Client, sdc *SDConfig) *kvWatcher {
+	path := fmt.Sprintf("/v1/kv/%s?recurse", sdc.Prefix)
+	if sdc.Datacenter != "" {
+		path += "&dc=" + sdc.Datacenter
+	}
+	if sdc.Namespace != "" {
+		path += "&ns=" + sdc.Namespace
+	}
+	if sdc.Partition != "" {
+		path += "&partition=" + sdc.Partition
+	}
+	allowStale := true
+	if sdc.AllowStale != nil {
+		allowStale = *sdc.AllowStale
+	}
+	maxStaleness := defaultMaxStaleness
+	if sdc.MaxStaleness != "" {
+		d, err := time.ParseDuration(sdc.MaxStaleness)
+		if err != nil {
+			logger.Errorf("cannot parse max_staleness=%q; using the default %s: %s", sdc.MaxStaleness, defaultMaxStaleness, err)
+		} else {
+			maxStaleness = d
+		}
+	}
+	kw := &kvWatcher{
+		client:            client,
+		sdc:               sdc,
+		path:              path,
+		allowStale:        allowStale,
+		requireConsistent: sdc.RequireConsistent,
+		maxStaleness:      maxStaleness,
+		entries:           make(map[string]kvPair),
+		stopCh:            make(chan struct{}),
+	}
+	kw.wg.Add(1)
+	go func() {
+		defer kw.wg.Done()
+		kw.watchForUpdates()
+	}()
+	return kw
+}
+
+func (kw *kvWatcher) mustStop() {
+	close(kw.stopCh)
+	kw.wg.Wait()
+}
+
+func (kw *kvWatcher) watchForUpdates() {
+	var index int64
+	for {
+		select {
+		case <-kw.stopCh:
+			return
+		default:
+		}
+		data, newIndex, err := consul.GetBlockingAPIResponse(kw.client, kw.path, index, kw.allowStale, kw.requireConsistent, kw.maxStaleness)
+		if err != nil {
+			logger.Errorf("error when performing blocking Consul KV API request at %q: %s", kw.path, err)
+			continue
+		}
+		index = newIndex
+		pairs, err := parseKVPairs(data)
+		if err != nil {
+			logger.Errorf("cannot parse Consul KV response from %q: %s", kw.path, err)
+			continue
+		}
+		kw.mu.Lock()
+		kw.entries = pairs
+		kw.mu.Unlock()
+	}
+}
+
+func parseKVPairs(data []byte) (map[string]kvPair, error) {
+	var raw []kvPair
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal %q: %w", data, err)
+	}
+	m := make(map[string]kvPair, len(raw))
+	for _, r := range raw {
+		m[r.Key] = r
+	}
+	return m, nil
+}
+
+// parseKVValue parses a decoded KV value as either a plain "host:port" string or a JSON object.
+func parseKVValue(raw string) (addr string, labels map[string]string, err error) {
+	trimmed := strings.TrimSpace(raw)
+	if strings.HasPrefix(trimmed, "{") {
+		var v kvValue
+		if err := json.Unmarshal([]byte(trimmed), &v); err != nil {
+			return "", nil, fmt.Errorf("cannot parse JSON KV value %q: %w", raw, err)
+		}
+		if v.Port > 0 {
+			return net.JoinHostPort(v.Address, strconv.Itoa(v.Port)), v.Labels, nil
+		}
+		return v.Address, v.Labels, nil
+	}
+	return trimmed, nil, nil
+}
+
+func (kw *kvWatcher) getLabels() []map[string]string {
+	kw.mu.Lock()
+	entries := kw.entries
+	kw.mu.Unlock()
+
+	var ms []map[string]string
+	for key, pair := range entries {
+		decoded, err := base64.StdEncoding.DecodeString(pair.Value)
+		if err != nil {
+			logger.Errorf("cannot base64-decode value for Consul KV key %q: %s", key, err)
+			continue
+		}
+		addr, labels, err := parseKVValue(string(decoded))
+		if err != nil {
+			logger.Errorf("cannot parse value for Consul KV key %q: %s", key, err)
+			continue
+		}
+		if addr == "" {
+			continue
+		}
+		m := map[string]string{
+			"__address__":          addr,
+			"__meta_consulkv_key":  key,
+			"__meta_consulkv_path": kw.sdc.Prefix,
+		}
+		for k, v := range labels {
+			m[discoveryutils.SanitizeLabelName("__meta_consulkv_label_"+k)] = v
+		}
+		ms = append(ms, m)
+	}
+	return ms
+}
@@ -0,0 +1,65 @@
+package consulkv
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseKVPairs(t *testing.T) {
+	data := []byte(`[
+		{"Key": "targets/a", "Value": "aGVsbG8="},
+		{"Key": "targets/b", "Value": "d29ybGQ="}
+	]`)
+	pairs, err := parseKVPairs(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := map[string]kvPair{
+		"targets/a": {Key: "targets/a", Value: "aGVsbG8="},
+		"targets/b": {Key: "targets/b", Value: "d29ybGQ="},
+	}
+	if !reflect.DeepEqual(pairs, expected) {
+		t.Fatalf("unexpected pairs\ngot:  %+v\nwant: %+v", pairs, expected)
+	}
+}
+
+func TestParseKVPairsError(t *testing.T) {
+	if _, err := parseKVPairs([]byte("not json")); err == nil {
+		t.Fatalf("expected an error when parsing invalid JSON")
+	}
+}
+
+func TestParseKVValue(t *testing.T) {
+	f := func(raw, expectedAddr string, expectedLabels map[string]string) {
+		t.Helper()
+		addr, labels, err := parseKVValue(raw)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", raw, err)
+		}
+		if addr != expectedAddr {
+			t.Fatalf("unexpected addr for %q; got %q; want %q", raw, addr, expectedAddr)
+		}
+		if !reflect.DeepEqual(labels, expectedLabels) {
+			t.Fatalf("unexpected labels for %q\ngot:  %+v\nwant: %+v", raw, labels, expectedLabels)
+		}
+	}
+
+	// Plain "host:port" string.
+	f("10.0.0.1:8080", "10.0.0.1:8080", nil)
+
+	// Whitespace around a plain value must be trimmed.
+	f("  10.0.0.1:8080  \n", "10.0.0.1:8080", nil)
+
+	// JSON object with an explicit port.
+	f(`{"address": "10.0.0.1", "port": 8080, "labels": {"env": "prod"}}`,
+		"10.0.0.1:8080", map[string]string{"env": "prod"})
+
+	// JSON object without a port uses address as-is.
+	f(`{"address": "10.0.0.1:9090"}`, "10.0.0.1:9090", nil)
+}
+
+func TestParseKVValueError(t *testing.T) {
+	if _, _, err := parseKVValue(`{"address": `); err == nil {
+		t.Fatalf("expected an error when parsing invalid JSON KV value")
+	}
+}